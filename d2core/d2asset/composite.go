@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/OpenDiablo2/OpenDiablo2/d2common/d2data"
 	"github.com/OpenDiablo2/OpenDiablo2/d2common/d2enum"
@@ -11,6 +12,15 @@ import (
 	"github.com/OpenDiablo2/OpenDiablo2/d2common/d2interface"
 )
 
+// loaderMu serializes calls into the package-level asset loaders
+// (FileExists, loadCOF, LoadAnimationWithEffect) that createCompositeMode
+// depends on. Those loaders were previously only ever invoked from the
+// single render goroutine; precaching now calls them from background worker
+// goroutines as well as from the render goroutine's own synchronous
+// fallback on a cache miss, and none of them are documented as safe for
+// concurrent use. Guard them with one mutex until/unless they are.
+var loaderMu sync.Mutex
+
 // Composite is a composite entity animation
 type Composite struct {
 	baseType    d2enum.ObjectType
@@ -20,6 +30,8 @@ type Composite struct {
 	direction   int
 	equipment   [d2enum.CompositeTypeMax]string
 	mode        *compositeMode
+	onFinished  func()
+	frameEvents map[string]map[int][]func()
 }
 
 // CreateComposite creates a Composite from a given ObjectLookupRecord and palettePath.
@@ -34,14 +46,47 @@ func (c *Composite) Advance(elapsed float64) error {
 		return nil
 	}
 
-	c.mode.lastFrameTime += elapsed
-	framesToAdd := int(c.mode.lastFrameTime / c.mode.animationSpeed)
-	c.mode.lastFrameTime -= float64(framesToAdd) * c.mode.animationSpeed
-	c.mode.frameIndex += framesToAdd
-	c.mode.playedCount += c.mode.frameIndex / c.mode.frameCount
-	c.mode.frameIndex %= c.mode.frameCount
+	// mode is pinned for the duration of this call: an onFinished/frame-event
+	// callback may itself call SetMode (e.g. "attack animation finished ->
+	// return to idle"), which reassigns c.mode. If that happens mid-loop, the
+	// remaining leftover frame increments belong to the mode this Advance call
+	// started with, not the new one, so bail out as soon as c.mode changes
+	// instead of continuing to mutate/fire events against a mode the
+	// Composite has already moved on from.
+	mode := c.mode
+
+	mode.lastFrameTime += elapsed
+	framesToAdd := int(mode.lastFrameTime / mode.animationSpeed)
+	mode.lastFrameTime -= float64(framesToAdd) * mode.animationSpeed
+
+	events := c.frameEvents[mode.animationMode.String()]
+
+	for i := 0; i < framesToAdd; i++ {
+		mode.frameIndex++
+
+		if mode.frameIndex >= mode.frameCount {
+			mode.frameIndex -= mode.frameCount
+			mode.playedCount++
+
+			if c.onFinished != nil {
+				c.onFinished()
+			}
+
+			if c.mode != mode {
+				return nil
+			}
+		}
+
+		for _, cb := range events[mode.frameIndex] {
+			cb()
 
-	for _, layer := range c.mode.layers {
+			if c.mode != mode {
+				return nil
+			}
+		}
+	}
+
+	for _, layer := range mode.layers {
 		if layer != nil {
 			if err := layer.Advance(elapsed); err != nil {
 				return err
@@ -102,17 +147,73 @@ func (c *Composite) SetMode(animationMode animationMode, weaponClass string) err
 		return nil
 	}
 
-	mode, err := c.createMode(animationMode, weaponClass)
-	if err != nil {
-		return err
+	key := makeModeCacheKey(c.token, c.palettePath, animationMode, weaponClass, c.equipment)
+
+	mode, found := sharedModeCache().get(key)
+	if !found {
+		built, err := c.createMode(animationMode, weaponClass)
+		if err != nil {
+			return err
+		}
+
+		mode = built
 	}
 
-	c.resetPlayedCount()
+	resetPlayback(mode)
 	c.mode = mode
+	c.onFinished = nil
+	c.frameEvents = nil
+	c.applyDirection(mode)
 
 	return nil
 }
 
+// SetOnFinished registers a callback that fires each time the current animation
+// mode completes a full cycle through its frames. It replaces any previously
+// registered callback.
+func (c *Composite) SetOnFinished(cb func()) {
+	c.onFinished = cb
+}
+
+// SetOnFrame registers a callback that fires when the current animation mode's
+// frame counter reaches the given frame index. It is a convenience wrapper
+// around RegisterFrameEvent for the composite's currently active mode.
+func (c *Composite) SetOnFrame(frame int, cb func()) {
+	if c.mode == nil {
+		return
+	}
+
+	c.RegisterFrameEvent(c.mode.animationMode, frame, cb)
+}
+
+// RegisterFrameEvent registers a callback that fires whenever the given
+// animation mode's frame counter reaches frame. This lets callers (attack
+// resolution, sound triggers, projectile spawning) hook specific frames such
+// as an attack hit frame or a missile-release frame instead of polling
+// GetPlayedCount. Every registration, for the active mode or any other, is
+// cleared on the next call to SetMode, so callers must re-register each time
+// the relevant mode is (re-)entered rather than once up front.
+func (c *Composite) RegisterFrameEvent(mode animationMode, frame int, cb func()) {
+	if c.frameEvents == nil {
+		c.frameEvents = make(map[string]map[int][]func())
+	}
+
+	key := mode.String()
+	if c.frameEvents[key] == nil {
+		c.frameEvents[key] = make(map[int][]func())
+	}
+
+	c.frameEvents[key][frame] = append(c.frameEvents[key][frame], cb)
+}
+
+// ClearFrameEvents removes every callback previously registered via
+// RegisterFrameEvent/SetOnFrame, for every animation mode. SetMode already
+// does this automatically; callers only need it to drop registrations
+// without also changing mode.
+func (c *Composite) ClearFrameEvents() {
+	c.frameEvents = nil
+}
+
 // Equip changes the current layer configuration
 func (c *Composite) Equip(equipment *[d2enum.CompositeTypeMax]string) error {
 	c.equipment = *equipment
@@ -120,13 +221,21 @@ func (c *Composite) Equip(equipment *[d2enum.CompositeTypeMax]string) error {
 		return nil
 	}
 
-	mode, err := c.createMode(c.mode.animationMode, c.mode.weaponClass)
+	key := makeModeCacheKey(c.token, c.palettePath, c.mode.animationMode, c.mode.weaponClass, c.equipment)
 
-	if err != nil {
-		return err
+	mode, found := sharedModeCache().get(key)
+	if !found {
+		built, err := c.createMode(c.mode.animationMode, c.mode.weaponClass)
+		if err != nil {
+			return err
+		}
+
+		mode = built
 	}
 
+	resetPlayback(mode)
 	c.mode = mode
+	c.applyDirection(mode)
 
 	return nil
 }
@@ -145,8 +254,17 @@ func (c *Composite) SetAnimSpeed(speed int) {
 // SetDirection sets the direction of the composite and its layers
 func (c *Composite) SetDirection(direction int) {
 	c.direction = direction
-	for layerIdx := range c.mode.layers {
-		layer := c.mode.layers[layerIdx]
+	c.applyDirection(c.mode)
+}
+
+// applyDirection pushes the Composite's current direction onto mode's
+// layers. A mode claimed from the shared precache cache may have been built
+// for a direction the Composite faced at precache time, which can differ
+// from c.direction by the time it's claimed, so SetMode/Equip call this
+// after every claim to keep the claimed mode's layers in sync.
+func (c *Composite) applyDirection(mode *compositeMode) {
+	for layerIdx := range mode.layers {
+		layer := mode.layers[layerIdx]
 		if layer != nil {
 			if err := layer.SetDirection(c.direction); err != nil {
 				fmt.Printf("failed to set direction of layer: %d, err: %v\n", layerIdx, err)
@@ -201,10 +319,13 @@ func (c *Composite) SetCurrentFrame(frame int) {
 	}
 }
 
-func (c *Composite) resetPlayedCount() {
-	if c.mode != nil {
-		c.mode.playedCount = 0
-	}
+// resetPlayback zeroes a compositeMode's playback counters so that, whether
+// it was just built or claimed from the precache pool, it always starts
+// playing from frame zero.
+func resetPlayback(mode *compositeMode) {
+	mode.frameIndex = 0
+	mode.lastFrameTime = 0
+	mode.playedCount = 0
 }
 
 type animationMode interface {
@@ -226,7 +347,21 @@ type compositeMode struct {
 }
 
 func (c *Composite) createMode(animationMode animationMode, weaponClass string) (*compositeMode, error) {
-	cofPath := fmt.Sprintf("%s/%s/COF/%s%s%s.COF", c.basePath, c.token, c.token, animationMode, weaponClass)
+	return createCompositeMode(c.token, c.basePath, c.palettePath, c.direction, c.equipment, animationMode, weaponClass)
+}
+
+// createCompositeMode builds a compositeMode from plain arguments rather than
+// a *Composite receiver so it can be called safely from precache worker
+// goroutines without racing against the owning Composite's mutable fields.
+// It takes loaderMu for its whole body since it's now called concurrently
+// from multiple precache workers as well as the render goroutine's
+// synchronous fallback on a cache miss.
+func createCompositeMode(token, basePath, palettePath string, direction int,
+	equipment [d2enum.CompositeTypeMax]string, animationMode animationMode, weaponClass string) (*compositeMode, error) {
+	loaderMu.Lock()
+	defer loaderMu.Unlock()
+
+	cofPath := fmt.Sprintf("%s/%s/COF/%s%s%s.COF", basePath, token, token, animationMode, weaponClass)
 	if exists, _ := FileExists(cofPath); !exists {
 		return nil, errors.New("composite not found")
 	}
@@ -236,7 +371,7 @@ func (c *Composite) createMode(animationMode animationMode, weaponClass string)
 		return nil, err
 	}
 
-	animationKey := strings.ToLower(c.token + animationMode.String() + weaponClass)
+	animationKey := strings.ToLower(token + animationMode.String() + weaponClass)
 
 	animationData := d2data.AnimationData[animationKey]
 	if len(animationData) == 0 {
@@ -253,7 +388,7 @@ func (c *Composite) createMode(animationMode animationMode, weaponClass string)
 	}
 
 	for _, cofLayer := range cof.CofLayers {
-		layerValue := c.equipment[cofLayer.Type]
+		layerValue := equipment[cofLayer.Type]
 		if layerValue == "" {
 			layerValue = "lit"
 		}
@@ -264,13 +399,13 @@ func (c *Composite) createMode(animationMode animationMode, weaponClass string)
 			drawEffect = cofLayer.DrawEffect
 		}
 
-		layer, err := c.loadCompositeLayer(cofLayer.Type.String(), layerValue, animationMode.String(),
-			cofLayer.WeaponClass.String(), c.palettePath, drawEffect)
+		layer, err := loadCompositeLayer(basePath, token, cofLayer.Type.String(), layerValue, animationMode.String(),
+			cofLayer.WeaponClass.String(), palettePath, drawEffect)
 		if err == nil {
 			layer.SetPlaySpeed(mode.animationSpeed)
 			layer.PlayForward()
 
-			if err := layer.SetDirection(c.direction); err != nil {
+			if err := layer.SetDirection(direction); err != nil {
 				return nil, err
 			}
 
@@ -281,11 +416,11 @@ func (c *Composite) createMode(animationMode animationMode, weaponClass string)
 	return mode, nil
 }
 
-func (c *Composite) loadCompositeLayer(layerKey, layerValue, animationMode, weaponClass,
+func loadCompositeLayer(basePath, token, layerKey, layerValue, animationMode, weaponClass,
 	palettePath string, drawEffect d2enum.DrawEffect) (d2interface.Animation, error) {
 	animationPaths := []string{
-		fmt.Sprintf("%s/%s/%s/%s%s%s%s%s.dcc", c.basePath, c.token, layerKey, c.token, layerKey, layerValue, animationMode, weaponClass),
-		fmt.Sprintf("%s/%s/%s/%s%s%s%s%s.dc6", c.basePath, c.token, layerKey, c.token, layerKey, layerValue, animationMode, weaponClass),
+		fmt.Sprintf("%s/%s/%s/%s%s%s%s%s.dcc", basePath, token, layerKey, token, layerKey, layerValue, animationMode, weaponClass),
+		fmt.Sprintf("%s/%s/%s/%s%s%s%s%s.dc6", basePath, token, layerKey, token, layerKey, layerValue, animationMode, weaponClass),
 	}
 
 	for _, animationPath := range animationPaths {
@@ -0,0 +1,304 @@
+package d2asset
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"fmt"
+	"sync"
+
+	"github.com/OpenDiablo2/OpenDiablo2/d2common/d2enum"
+	"github.com/OpenDiablo2/OpenDiablo2/d2common/d2interface"
+)
+
+// defaultModeCacheSize is the number of precomputed-but-unclaimed
+// compositeMode values the shared pool keeps resident before evicting the
+// least-recently-added entry.
+const defaultModeCacheSize = 64
+
+// defaultPrecacheWorkers is the number of background goroutines available to
+// load composite modes submitted via PrecacheMode/PrecacheEquipment.
+const defaultPrecacheWorkers = 4
+
+// ModeEvictionHook, when set, is invoked with the animation layers of a
+// compositeMode immediately before it is evicted from the shared mode cache,
+// allowing callers to release any backing render surfaces.
+var ModeEvictionHook func(layers []d2interface.Animation)
+
+// ModeCacheMetrics reports hit/miss counters for the shared compositeMode
+// cache, useful for profiling precache effectiveness.
+type ModeCacheMetrics struct {
+	Hits   int
+	Misses int
+}
+
+// ModeCacheStats returns the current hit/miss counters for the shared
+// compositeMode cache.
+func ModeCacheStats() ModeCacheMetrics {
+	return sharedModeCache().metrics()
+}
+
+// SetModeCacheSize overrides the shared compositeMode cache capacity. Useful
+// for tuning the memory budget at startup, e.g. a larger cache at character
+// select where many weapon/equipment combinations are precached.
+func SetModeCacheSize(capacity int) {
+	mc := sharedModeCache()
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.capacity = capacity
+}
+
+// modeCacheKey uniquely identifies a compositeMode built from a token,
+// palette, weapon class, animation mode and equipment set.
+type modeCacheKey string
+
+func makeModeCacheKey(token, palettePath string, animationMode animationMode,
+	weaponClass string, equipment [d2enum.CompositeTypeMax]string) modeCacheKey {
+	h := sha1.New()
+
+	for _, e := range equipment {
+		h.Write([]byte(e))
+		h.Write([]byte{0})
+	}
+
+	return modeCacheKey(fmt.Sprintf("%s|%s|%s|%s|%x", token, palettePath, animationMode.String(),
+		weaponClass, h.Sum(nil)))
+}
+
+// modeCacheEntry is the value stored in the LRU's backing list.
+type modeCacheEntry struct {
+	key  modeCacheKey
+	mode *compositeMode
+}
+
+// modeCache is a bounded, thread-safe pool of precomputed compositeMode
+// values, shared across every Composite. A compositeMode holds per-instance
+// playback state (frameIndex, playedCount, lastFrameTime) and mutable layer
+// animations, so it cannot be reused by more than one Composite at a time:
+// get() pops the entry and hands over exclusive ownership to the caller.
+// Capacity bounds how many precomputed-but-not-yet-claimed modes are kept
+// around; modes that are claimed are removed from the pool immediately and
+// never touched by eviction.
+type modeCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[modeCacheKey]*list.Element
+	order    *list.List
+	hits     int
+	misses   int
+}
+
+func newModeCache(capacity int) *modeCache {
+	return &modeCache{
+		capacity: capacity,
+		items:    make(map[modeCacheKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get pops and returns the compositeMode stored under key, giving the caller
+// exclusive ownership of it. A popped entry is removed from the pool so no
+// other Composite can be handed the same, now-mutable, instance.
+func (mc *modeCache) get(key modeCacheKey) (*compositeMode, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	elem, found := mc.items[key]
+	if !found {
+		mc.misses++
+		return nil, false
+	}
+
+	mc.order.Remove(elem)
+	delete(mc.items, key)
+	mc.hits++
+
+	return elem.Value.(*modeCacheEntry).mode, true
+}
+
+// has reports whether key is currently present in the pool without claiming
+// it, for callers that only need to know whether a precache would be
+// redundant.
+func (mc *modeCache) has(key modeCacheKey) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	_, found := mc.items[key]
+
+	return found
+}
+
+func (mc *modeCache) put(key modeCacheKey, mode *compositeMode) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if elem, found := mc.items[key]; found {
+		entry := elem.Value.(*modeCacheEntry)
+
+		if ModeEvictionHook != nil && entry.mode != mode {
+			ModeEvictionHook(entry.mode.layers)
+		}
+
+		entry.mode = mode
+		mc.order.MoveToFront(elem)
+
+		return
+	}
+
+	elem := mc.order.PushFront(&modeCacheEntry{key: key, mode: mode})
+	mc.items[key] = elem
+
+	for mc.order.Len() > mc.capacity {
+		mc.evictOldest()
+	}
+}
+
+func (mc *modeCache) evictOldest() {
+	elem := mc.order.Back()
+	if elem == nil {
+		return
+	}
+
+	entry := elem.Value.(*modeCacheEntry)
+
+	if ModeEvictionHook != nil {
+		ModeEvictionHook(entry.mode.layers)
+	}
+
+	mc.order.Remove(elem)
+	delete(mc.items, entry.key)
+}
+
+func (mc *modeCache) metrics() ModeCacheMetrics {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	return ModeCacheMetrics{Hits: mc.hits, Misses: mc.misses}
+}
+
+var (
+	sharedModeCacheOnce sync.Once
+	sharedModeCacheInst *modeCache
+)
+
+func sharedModeCache() *modeCache {
+	sharedModeCacheOnce.Do(func() {
+		sharedModeCacheInst = newModeCache(defaultModeCacheSize)
+	})
+
+	return sharedModeCacheInst
+}
+
+// precachePool is a small fixed-size worker pool that loads compositeMode
+// values off the render thread.
+type precachePool struct {
+	once sync.Once
+	jobs chan func()
+}
+
+var globalPrecachePool precachePool
+
+func precacheWorkers() *precachePool {
+	globalPrecachePool.once.Do(func() {
+		globalPrecachePool.jobs = make(chan func(), defaultModeCacheSize)
+
+		for i := 0; i < defaultPrecacheWorkers; i++ {
+			go globalPrecachePool.run()
+		}
+	})
+
+	return &globalPrecachePool
+}
+
+func (p *precachePool) run() {
+	for job := range p.jobs {
+		job()
+	}
+}
+
+// submit queues job for the pool's workers, or runs it on its own goroutine if
+// the pool's queue is full, so callers are never blocked waiting for a worker.
+func (p *precachePool) submit(job func()) {
+	select {
+	case p.jobs <- job:
+	default:
+		go job()
+	}
+}
+
+// PrecacheMode asynchronously loads the compositeMode for the given animation
+// mode and weapon class using the Composite's current equipment and palette,
+// storing the result in the shared cache. The returned channel receives the
+// load error (nil on success) exactly once and is then closed. If the mode is
+// already cached, the channel receives nil immediately without touching the
+// worker pool.
+func (c *Composite) PrecacheMode(animationMode animationMode, weaponClass string) <-chan error {
+	result := make(chan error, 1)
+
+	key := makeModeCacheKey(c.token, c.palettePath, animationMode, weaponClass, c.equipment)
+
+	if sharedModeCache().has(key) {
+		result <- nil
+		close(result)
+
+		return result
+	}
+
+	token, basePath, palettePath, direction, equipment := c.token, c.basePath, c.palettePath, c.direction, c.equipment
+
+	precacheWorkers().submit(func() {
+		built, err := createCompositeMode(token, basePath, palettePath, direction, equipment, animationMode, weaponClass)
+		if err == nil {
+			sharedModeCache().put(key, built)
+		}
+
+		result <- err
+		close(result)
+	})
+
+	return result
+}
+
+// PrecacheEquipment loads the Composite's current animation mode under the
+// given equipment configuration in the background and stores it in the
+// shared cache, without blocking or mutating the Composite itself. A
+// subsequent Equip call with the same equipment will hit the cache instead
+// of loading synchronously. Call PrecacheMode once per animation mode (idle,
+// walk, run, attack, ...) to warm the whole set, e.g. at character select.
+func (c *Composite) PrecacheEquipment(equipment *[d2enum.CompositeTypeMax]string) <-chan error {
+	result := make(chan error, 1)
+
+	if c.mode == nil {
+		result <- nil
+		close(result)
+
+		return result
+	}
+
+	animationMode, weaponClass := c.mode.animationMode, c.mode.weaponClass
+	equipmentCopy := *equipment
+
+	key := makeModeCacheKey(c.token, c.palettePath, animationMode, weaponClass, equipmentCopy)
+
+	if sharedModeCache().has(key) {
+		result <- nil
+		close(result)
+
+		return result
+	}
+
+	token, basePath, palettePath, direction := c.token, c.basePath, c.palettePath, c.direction
+
+	precacheWorkers().submit(func() {
+		built, err := createCompositeMode(token, basePath, palettePath, direction, equipmentCopy, animationMode, weaponClass)
+		if err == nil {
+			sharedModeCache().put(key, built)
+		}
+
+		result <- err
+		close(result)
+	})
+
+	return result
+}
@@ -0,0 +1,225 @@
+package d2asset
+
+import (
+	"testing"
+
+	"github.com/OpenDiablo2/OpenDiablo2/d2common/d2enum"
+	"github.com/OpenDiablo2/OpenDiablo2/d2common/d2interface"
+)
+
+func TestModeCacheGetPopsExclusiveOwnership(t *testing.T) {
+	mc := newModeCache(2)
+	mode := &compositeMode{}
+
+	mc.put("k1", mode)
+
+	got, found := mc.get("k1")
+	if !found || got != mode {
+		t.Fatalf("expected get to return the mode that was put")
+	}
+
+	if _, found := mc.get("k1"); found {
+		t.Fatalf("get should have popped the entry; a second get must miss")
+	}
+}
+
+func TestModeCacheHasDoesNotClaim(t *testing.T) {
+	mc := newModeCache(2)
+	mode := &compositeMode{}
+
+	mc.put("k1", mode)
+
+	if !mc.has("k1") {
+		t.Fatalf("expected has to report the entry present")
+	}
+
+	if got, found := mc.get("k1"); !found || got != mode {
+		t.Fatalf("has must not claim the entry; get should still find it afterward")
+	}
+}
+
+func TestModeCacheEvictsLeastRecentlyAdded(t *testing.T) {
+	mc := newModeCache(2)
+
+	prevHook := ModeEvictionHook
+	var evictedCount int
+	ModeEvictionHook = func(layers []d2interface.Animation) { evictedCount++ }
+	defer func() { ModeEvictionHook = prevHook }()
+
+	mc.put("a", &compositeMode{})
+	mc.put("b", &compositeMode{})
+	mc.put("c", &compositeMode{})
+
+	if mc.has("a") {
+		t.Fatalf("expected the oldest entry to be evicted once capacity was exceeded")
+	}
+
+	if !mc.has("b") || !mc.has("c") {
+		t.Fatalf("expected the two most recently put entries to remain cached")
+	}
+
+	if evictedCount != 1 {
+		t.Fatalf("expected ModeEvictionHook to run once, ran %d times", evictedCount)
+	}
+}
+
+func TestModeCachePutRunsEvictionHookOnOverwrite(t *testing.T) {
+	mc := newModeCache(2)
+
+	prevHook := ModeEvictionHook
+	var evictedCount int
+	ModeEvictionHook = func(layers []d2interface.Animation) { evictedCount++ }
+	defer func() { ModeEvictionHook = prevHook }()
+
+	mc.put("a", &compositeMode{})
+	mc.put("a", &compositeMode{})
+
+	if evictedCount != 1 {
+		t.Fatalf("expected overwriting an existing entry to run the eviction hook once, ran %d times", evictedCount)
+	}
+}
+
+func TestModeCacheMetrics(t *testing.T) {
+	mc := newModeCache(4)
+	mc.put("a", &compositeMode{})
+
+	mc.get("a")
+	mc.get("a")
+
+	m := mc.metrics()
+	if m.Hits != 1 || m.Misses != 1 {
+		t.Fatalf("expected 1 hit and 1 miss, got %+v", m)
+	}
+}
+
+func TestPrecachePoolSubmitRunsJobs(t *testing.T) {
+	p := &precachePool{jobs: make(chan func(), 1)}
+	go p.run()
+
+	const jobCount = 3
+
+	done := make(chan struct{}, jobCount)
+	for i := 0; i < jobCount; i++ {
+		p.submit(func() { done <- struct{}{} })
+	}
+
+	for i := 0; i < jobCount; i++ {
+		<-done
+	}
+}
+
+func TestPrecachePoolSubmitDoesNotBlockWhenQueueIsFull(t *testing.T) {
+	p := &precachePool{jobs: make(chan func())}
+
+	block := make(chan struct{})
+	done := make(chan struct{}, 1)
+
+	p.submit(func() { <-block })
+	p.submit(func() { done <- struct{}{} })
+
+	close(block)
+
+	<-done
+}
+
+// fakeAnimation embeds d2interface.Animation so it satisfies the full
+// interface without having to stub every method; only SetDirection, the one
+// method these tests care about, is overridden.
+type fakeAnimation struct {
+	d2interface.Animation
+	direction int
+}
+
+func (f *fakeAnimation) SetDirection(direction int) error {
+	f.direction = direction
+	return nil
+}
+
+// TestSetModeAppliesCurrentDirectionToPrecachedMode exercises the real public
+// API (not modeCache internals): a mode precached while the Composite faced
+// one direction, then claimed by SetMode after the Composite has turned to
+// face another, must have its layers' direction brought up to date rather
+// than rendering stale.
+func TestSetModeAppliesCurrentDirectionToPrecachedMode(t *testing.T) {
+	layer := &fakeAnimation{direction: 0}
+
+	c := &Composite{
+		token:       "token",
+		palettePath: "palette",
+		direction:   5,
+	}
+
+	key := makeModeCacheKey(c.token, c.palettePath, stubAnimationMode("neutral"), "", c.equipment)
+	sharedModeCache().put(key, &compositeMode{
+		animationMode: stubAnimationMode("neutral"),
+		weaponClass:   "",
+		frameCount:    1,
+		playedCount:   3,
+		frameIndex:    2,
+		layers:        []d2interface.Animation{layer},
+	})
+
+	if err := c.SetMode(stubAnimationMode("neutral"), ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if layer.direction != 5 {
+		t.Fatalf("expected claimed mode's layer direction to be updated to 5, got %d", layer.direction)
+	}
+
+	if c.mode.frameIndex != 0 || c.mode.playedCount != 0 {
+		t.Fatalf("expected claimed mode's playback counters to be reset, got frameIndex=%d playedCount=%d",
+			c.mode.frameIndex, c.mode.playedCount)
+	}
+
+	if sharedModeCache().has(key) {
+		t.Fatalf("expected SetMode to claim (pop) the precached entry, but it is still cached")
+	}
+}
+
+// TestEquipAppliesCurrentDirectionToPrecachedMode is the Equip-path
+// counterpart of TestSetModeAppliesCurrentDirectionToPrecachedMode: a mode
+// precached via PrecacheEquipment for one direction must have its layers'
+// direction refreshed when Equip later claims it for a Composite facing a
+// different direction.
+func TestEquipAppliesCurrentDirectionToPrecachedMode(t *testing.T) {
+	layer := &fakeAnimation{direction: 0}
+
+	c := &Composite{
+		token:       "token",
+		palettePath: "palette",
+		direction:   7,
+		mode: &compositeMode{
+			animationMode: stubAnimationMode("neutral"),
+			weaponClass:   "",
+		},
+	}
+
+	equipment := [d2enum.CompositeTypeMax]string{"helm"}
+	key := makeModeCacheKey(c.token, c.palettePath, stubAnimationMode("neutral"), "", equipment)
+	sharedModeCache().put(key, &compositeMode{
+		animationMode: stubAnimationMode("neutral"),
+		weaponClass:   "",
+		frameCount:    1,
+		playedCount:   4,
+		frameIndex:    3,
+		layers:        []d2interface.Animation{layer},
+	})
+
+	if err := c.Equip(&equipment); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if layer.direction != 7 {
+		t.Fatalf("expected claimed mode's layer direction to be updated to 7, got %d", layer.direction)
+	}
+
+	if c.mode.frameIndex != 0 || c.mode.playedCount != 0 {
+		t.Fatalf("expected claimed mode's playback counters to be reset, got frameIndex=%d playedCount=%d",
+			c.mode.frameIndex, c.mode.playedCount)
+	}
+
+	if sharedModeCache().has(key) {
+		t.Fatalf("expected Equip to claim (pop) the precached entry, but it is still cached")
+	}
+}
@@ -0,0 +1,121 @@
+package d2asset
+
+import "testing"
+
+type stubAnimationMode string
+
+func (s stubAnimationMode) String() string { return string(s) }
+
+func TestAdvanceFiresFinishedAndFrameEventsAcrossWraparound(t *testing.T) {
+	c := &Composite{
+		mode: &compositeMode{
+			animationMode:  stubAnimationMode("attack"),
+			frameCount:     4,
+			animationSpeed: 1.0,
+		},
+	}
+
+	var finishedCount, frameTwoCount int
+
+	c.SetOnFinished(func() { finishedCount++ })
+	c.RegisterFrameEvent(stubAnimationMode("attack"), 2, func() { frameTwoCount++ })
+
+	// animationSpeed is 1.0, so 10 elapsed "seconds" advances 10 whole frames,
+	// wrapping the 4-frame cycle twice and landing on frame index 2.
+	if err := c.Advance(10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.mode.frameIndex != 2 {
+		t.Fatalf("expected frameIndex 2 after wraparound, got %d", c.mode.frameIndex)
+	}
+
+	if c.mode.playedCount != 2 {
+		t.Fatalf("expected playedCount 2, got %d", c.mode.playedCount)
+	}
+
+	if finishedCount != 2 {
+		t.Fatalf("expected onFinished to fire twice, fired %d times", finishedCount)
+	}
+
+	if frameTwoCount != 3 {
+		t.Fatalf("expected frame-2 event to fire 3 times (indices 2, 6, 10), fired %d times", frameTwoCount)
+	}
+}
+
+func TestAdvanceStopsApplyingLeftoverFramesAfterReentrantSetMode(t *testing.T) {
+	oldMode := &compositeMode{
+		animationMode:  stubAnimationMode("attack"),
+		frameCount:     4,
+		animationSpeed: 1.0,
+	}
+	neutralMode := &compositeMode{
+		animationMode:  stubAnimationMode("idle"),
+		frameCount:     6,
+		animationSpeed: 1.0,
+	}
+
+	c := &Composite{mode: oldMode}
+
+	var finishedCount, frameTwoCount int
+
+	c.SetOnFinished(func() {
+		finishedCount++
+		// Simulate the obvious "attack finished -> return to idle" pattern:
+		// the callback itself reassigns c.mode mid-Advance.
+		c.mode = neutralMode
+		c.onFinished = nil
+	})
+	c.RegisterFrameEvent(stubAnimationMode("attack"), 2, func() { frameTwoCount++ })
+
+	// 10 whole frames at speed 1.0 would, without the reentrancy guard, wrap
+	// the 4-frame oldMode once (finishing on the 4th tick, which swaps in neutralMode),
+	// then keep applying the remaining 6 ticks to neutralMode using oldMode's
+	// stale frame-2 callback.
+	if err := c.Advance(10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.mode != neutralMode {
+		t.Fatalf("expected the mode swapped in by the callback to remain active")
+	}
+
+	if finishedCount != 1 {
+		t.Fatalf("expected onFinished to fire exactly once before the mode swap, fired %d times", finishedCount)
+	}
+
+	if frameTwoCount != 1 {
+		t.Fatalf("expected oldMode's frame-2 event to fire only for the pre-swap pass, fired %d times", frameTwoCount)
+	}
+
+	if oldMode.frameIndex != 0 {
+		t.Fatalf("expected oldMode to stop at frame 0 after its single wraparound, got %d", oldMode.frameIndex)
+	}
+
+	if neutralMode.frameIndex != 0 || neutralMode.playedCount != 0 {
+		t.Fatalf("expected the newly swapped-in mode to be untouched by the in-flight Advance call, got frameIndex=%d playedCount=%d",
+			neutralMode.frameIndex, neutralMode.playedCount)
+	}
+}
+
+func TestClearFrameEventsRemovesAllRegistrations(t *testing.T) {
+	c := &Composite{
+		mode: &compositeMode{
+			animationMode:  stubAnimationMode("attack"),
+			frameCount:     4,
+			animationSpeed: 1.0,
+		},
+	}
+
+	var fired int
+	c.SetOnFrame(1, func() { fired++ })
+	c.ClearFrameEvents()
+
+	if err := c.Advance(4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if fired != 0 {
+		t.Fatalf("expected cleared frame events not to fire, fired %d times", fired)
+	}
+}